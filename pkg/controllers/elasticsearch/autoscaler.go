@@ -0,0 +1,300 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+)
+
+const (
+	defaultTargetHeapPercent    = 75
+	defaultScaleDownHeapPercent = 40
+	diskWatermarkHighPercent    = 90
+
+	// defaultScaleUpStabilizationWindow and defaultScaleDownStabilizationWindow
+	// are used whenever a node pool doesn't set its own window: scaling up
+	// reacts fairly quickly since the cost of a false positive is a single
+	// extra node, while scaling down waits longer since a false positive
+	// drains a node that's about to be needed again.
+	defaultScaleUpStabilizationWindow   = time.Minute
+	defaultScaleDownStabilizationWindow = 5 * time.Minute
+)
+
+// Autoscaler scrapes per-node JVM heap and disk usage from a managed
+// cluster's _nodes/stats API and adjusts the Replicas of node pools that
+// have Spec.Autoscaling configured. Master pools are never autoscaled; this
+// is additionally enforced in verifyNodePool at admission time.
+type Autoscaler struct {
+	kubeClient      *kubernetes.Clientset
+	esClientFactory ESClientFactory
+	recorder        record.EventRecorder
+
+	// now is time.Now in production; tests substitute a fake clock to
+	// exercise stabilization windows without sleeping.
+	now func() time.Time
+}
+
+// NewAutoscaler returns an Autoscaler.
+func NewAutoscaler(cl *kubernetes.Clientset, esClientFactory ESClientFactory, recorder record.EventRecorder) *Autoscaler {
+	return &Autoscaler{
+		kubeClient:      cl,
+		esClientFactory: esClientFactory,
+		recorder:        recorder,
+		now:             time.Now,
+	}
+}
+
+// Reconcile evaluates the autoscaling policy of every node pool on es that
+// has Spec.Autoscaling set, and mutates NodePool.Replicas in place when a
+// scaling decision is made. It reports whether it changed es so the caller
+// knows whether the result needs persisting; es itself is never persisted by
+// Reconcile, since it is typically a copy the caller owns.
+func (a *Autoscaler) Reconcile(es *v1.ElasticsearchCluster) (bool, error) {
+	esClient := a.esClientFactory(es)
+
+	changed := false
+	for _, pool := range es.Spec.NodePools {
+		if pool.Autoscaling == nil || isMasterPool(pool) {
+			continue
+		}
+
+		poolChanged, err := a.reconcilePool(es, pool, esClient)
+		if err != nil {
+			return changed, fmt.Errorf("error autoscaling node pool '%s': %s", pool.Name, err.Error())
+		}
+		changed = changed || poolChanged
+	}
+
+	return changed, nil
+}
+
+func (a *Autoscaler) reconcilePool(es *v1.ElasticsearchCluster, pool *v1.ElasticsearchClusterNodePool, esClient esclient.Interface) (bool, error) {
+	stats, err := esClient.NodesStats()
+	if err != nil {
+		return false, fmt.Errorf("error fetching nodes stats: %s", err.Error())
+	}
+
+	poolStats := nodesInPool(stats, pool)
+	if len(poolStats) == 0 {
+		return false, nil
+	}
+
+	targetHeap := pool.Autoscaling.TargetHeapPercent
+	if targetHeap == 0 {
+		targetHeap = defaultTargetHeapPercent
+	}
+	scaleDownHeap := pool.Autoscaling.ScaleDownHeapPercent
+	if scaleDownHeap == 0 {
+		scaleDownHeap = defaultScaleDownHeapPercent
+	}
+
+	direction := ""
+	switch {
+	case medianHeapPercent(poolStats) > targetHeap || anyNodeOverDiskWatermark(poolStats):
+		direction = "up"
+	case pool.State != nil && pool.State.Persistence.Enabled && pool.Replicas > pool.Autoscaling.MinReplicas:
+		relocating, err := anyShardRelocating(esClient)
+		if err != nil {
+			return false, fmt.Errorf("error checking for relocating shards: %s", err.Error())
+		}
+		if allBelowHeapPercent(poolStats, scaleDownHeap) && !relocating {
+			direction = "down"
+		}
+	}
+
+	if direction == "" {
+		return a.clearPendingDecision(es), nil
+	}
+
+	pendingBefore := es.Status.Autoscaler.PendingDecision
+	if a.awaitingStabilization(es, pool, direction) {
+		return es.Status.Autoscaler.PendingDecision != pendingBefore, nil
+	}
+
+	if direction == "up" {
+		return a.scaleUp(es, pool, esClient)
+	}
+	return a.drainAndScaleDown(es, pool, esClient)
+}
+
+// awaitingStabilization records the first observation of a sustained
+// direction and reports whether the pool's stabilization window for that
+// direction has not yet elapsed, in which case the caller must not act this
+// cycle.
+func (a *Autoscaler) awaitingStabilization(es *v1.ElasticsearchCluster, pool *v1.ElasticsearchClusterNodePool, direction string) bool {
+	now := a.now()
+	status := es.Status.Autoscaler
+
+	if status.PendingDecision != direction {
+		es.Status.Autoscaler.PendingDecision = direction
+		es.Status.Autoscaler.PendingSince = metav1.NewTime(now)
+		return true
+	}
+
+	return now.Sub(status.PendingSince.Time) < stabilizationWindow(pool, direction)
+}
+
+// clearPendingDecision drops any in-progress stabilization tracking once a
+// pool is no longer over or under its thresholds, reporting whether it
+// changed es.
+func (a *Autoscaler) clearPendingDecision(es *v1.ElasticsearchCluster) bool {
+	if es.Status.Autoscaler.PendingDecision == "" {
+		return false
+	}
+	es.Status.Autoscaler.PendingDecision = ""
+	es.Status.Autoscaler.PendingSince = metav1.Time{}
+	return true
+}
+
+func stabilizationWindow(pool *v1.ElasticsearchClusterNodePool, direction string) time.Duration {
+	if direction == "up" {
+		if pool.Autoscaling.ScaleUpStabilizationWindowSeconds > 0 {
+			return time.Duration(pool.Autoscaling.ScaleUpStabilizationWindowSeconds) * time.Second
+		}
+		return defaultScaleUpStabilizationWindow
+	}
+
+	if pool.Autoscaling.ScaleDownStabilizationWindowSeconds > 0 {
+		return time.Duration(pool.Autoscaling.ScaleDownStabilizationWindowSeconds) * time.Second
+	}
+	return defaultScaleDownStabilizationWindow
+}
+
+// scaleUp increments Replicas and clears any shard-allocation exclusion left
+// over from a previous scale-down, since the new pod reuses the highest
+// ordinal that drainAndScaleDown last excluded; leaving the exclusion in
+// place would make the new node permanently ineligible for shards.
+func (a *Autoscaler) scaleUp(es *v1.ElasticsearchCluster, pool *v1.ElasticsearchClusterNodePool, esClient esclient.Interface) (bool, error) {
+	if pool.Autoscaling.MaxReplicas > 0 && pool.Replicas >= pool.Autoscaling.MaxReplicas {
+		return false, nil
+	}
+
+	if err := esClient.ExcludeNodeAllocation(""); err != nil {
+		return false, fmt.Errorf("error clearing shard allocation exclusion: %s", err.Error())
+	}
+
+	pool.Replicas++
+	es.Status.Autoscaler = v1.ElasticsearchClusterAutoscalerStatus{
+		LastDecision: "ScaleUp",
+		Reason:       fmt.Sprintf("node pool '%s' heap or disk usage above target for the stabilization window", pool.Name),
+		Time:         metav1.NewTime(a.now()),
+	}
+	a.recorder.Eventf(es, apiv1.EventTypeNormal, "ScaledUp", "scaled node pool '%s' up to %d replicas", pool.Name, pool.Replicas)
+	return true, nil
+}
+
+// drainAndScaleDown tags the node pool's highest-ordinal member for exclusion
+// from shard allocation and, once it no longer holds any shards, decrements
+// Replicas. It is called again on every reconcile until the node has
+// finished draining, so ExcludeNodeAllocation is issued repeatedly - this is
+// a no-op on the Elasticsearch side once the setting is already applied.
+func (a *Autoscaler) drainAndScaleDown(es *v1.ElasticsearchCluster, pool *v1.ElasticsearchClusterNodePool, esClient esclient.Interface) (bool, error) {
+	if pool.Replicas <= pool.Autoscaling.MinReplicas {
+		return a.clearPendingDecision(es), nil
+	}
+
+	leavingNode := fmt.Sprintf("%s-%d", pool.Name, pool.Replicas-1)
+
+	if err := esClient.ExcludeNodeAllocation(leavingNode); err != nil {
+		return false, fmt.Errorf("error excluding node '%s' from shard allocation: %s", leavingNode, err.Error())
+	}
+
+	drained, err := nodeHoldsNoShards(esClient, leavingNode)
+	if err != nil {
+		return false, fmt.Errorf("error checking drain status of node '%s': %s", leavingNode, err.Error())
+	}
+	if !drained {
+		logrus.Debugf("waiting for node '%s' to finish draining before scaling node pool '%s' down", leavingNode, pool.Name)
+		return false, nil
+	}
+
+	pool.Replicas--
+	es.Status.Autoscaler = v1.ElasticsearchClusterAutoscalerStatus{
+		LastDecision: "ScaleDown",
+		Reason:       fmt.Sprintf("node pool '%s' heap usage below target for the stabilization window", pool.Name),
+		Time:         metav1.NewTime(a.now()),
+	}
+	a.recorder.Eventf(es, apiv1.EventTypeNormal, "ScaledDown", "scaled node pool '%s' down to %d replicas after draining '%s'", pool.Name, pool.Replicas, leavingNode)
+	return true, nil
+}
+
+func nodeHoldsNoShards(esClient esclient.Interface, nodeName string) (bool, error) {
+	shards, err := esClient.CatShards()
+	if err != nil {
+		return false, err
+	}
+
+	for _, shard := range shards {
+		if shard.Node == nodeName {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func nodesInPool(stats *esclient.NodesStats, pool *v1.ElasticsearchClusterNodePool) []esclient.NodeStats {
+	var matched []esclient.NodeStats
+	for _, n := range stats.Nodes {
+		if strings.HasPrefix(n.Name, pool.Name+"-") {
+			matched = append(matched, n)
+		}
+	}
+	return matched
+}
+
+func medianHeapPercent(stats []esclient.NodeStats) int {
+	values := make([]int, len(stats))
+	for i, s := range stats {
+		values[i] = s.JVM.Mem.HeapUsedPercent
+	}
+	sort.Ints(values)
+	return values[len(values)/2]
+}
+
+func anyNodeOverDiskWatermark(stats []esclient.NodeStats) bool {
+	for _, s := range stats {
+		if s.FS.Total.TotalInBytes == 0 {
+			continue
+		}
+		used := s.FS.Total.TotalInBytes - s.FS.Total.AvailableInBytes
+		if int(used*100/s.FS.Total.TotalInBytes) >= diskWatermarkHighPercent {
+			return true
+		}
+	}
+	return false
+}
+
+func allBelowHeapPercent(stats []esclient.NodeStats, percent int) bool {
+	for _, s := range stats {
+		if s.JVM.Mem.HeapUsedPercent >= percent {
+			return false
+		}
+	}
+	return true
+}
+
+func anyShardRelocating(esClient esclient.Interface) (bool, error) {
+	shards, err := esClient.CatShards()
+	if err != nil {
+		return false, err
+	}
+
+	for _, shard := range shards {
+		if shard.State == "RELOCATING" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,181 @@
+package elasticsearch
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/record"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient/fake"
+)
+
+func dataPool(replicas int32) *v1.ElasticsearchClusterNodePool {
+	return &v1.ElasticsearchClusterNodePool{
+		Name:     "data",
+		Roles:    []string{"data"},
+		Replicas: replicas,
+		State: &v1.ElasticsearchClusterNodePoolState{
+			Stateful: true,
+			Persistence: v1.ElasticsearchClusterNodePoolPersistence{
+				Enabled: true,
+			},
+		},
+		Autoscaling: &v1.ElasticsearchClusterNodePoolAutoscaling{
+			MinReplicas: 1,
+		},
+	}
+}
+
+func nodeStats(heapPercent, diskUsedPercent int) esclient.NodeStats {
+	stats := esclient.NodeStats{Name: "data-0"}
+	stats.JVM.Mem.HeapUsedPercent = heapPercent
+	stats.FS.Total.TotalInBytes = 100
+	stats.FS.Total.AvailableInBytes = int64(100 - diskUsedPercent)
+	return stats
+}
+
+func TestAutoscalerReconcile(t *testing.T) {
+	tests := map[string]struct {
+		pool            *v1.ElasticsearchClusterNodePool
+		nodesStats      esclient.NodesStats
+		relocatingShard bool
+		settleWindow    bool
+		expectReplicas  int32
+	}{
+		"does not scale up on the first observation, to honour the stabilization window": {
+			pool:           dataPool(2),
+			nodesStats:     esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(90, 10)}},
+			expectReplicas: 2,
+		},
+		"scales up once heap has exceeded target for the stabilization window": {
+			pool:           dataPool(2),
+			nodesStats:     esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(90, 10)}},
+			settleWindow:   true,
+			expectReplicas: 3,
+		},
+		"scales up once disk has crossed the high watermark for the stabilization window": {
+			pool:           dataPool(2),
+			nodesStats:     esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(10, 95)}},
+			settleWindow:   true,
+			expectReplicas: 3,
+		},
+		"scales down once heap has been low for the stabilization window": {
+			pool:           dataPool(2),
+			nodesStats:     esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(10, 10)}},
+			settleWindow:   true,
+			expectReplicas: 1,
+		},
+		"does not scale down while shards are relocating": {
+			pool:            dataPool(2),
+			nodesStats:      esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(10, 10)}},
+			relocatingShard: true,
+			settleWindow:    true,
+			expectReplicas:  2,
+		},
+		"does not scale down past MinReplicas": {
+			pool:           dataPool(1),
+			nodesStats:     esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(10, 10)}},
+			settleWindow:   true,
+			expectReplicas: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			esClient := fake.New()
+			esClient.NodesStatsResponse = &test.nodesStats
+			if test.relocatingShard {
+				esClient.CatShardsResponse = []esclient.Shard{{State: "RELOCATING", Node: "data-1"}}
+			}
+
+			es := &v1.ElasticsearchCluster{
+				Spec: v1.ElasticsearchClusterSpec{
+					NodePools: []*v1.ElasticsearchClusterNodePool{test.pool},
+				},
+			}
+
+			now := time.Unix(0, 0)
+			autoscaler := NewAutoscaler(nil, func(*v1.ElasticsearchCluster) esclient.Interface { return esClient }, record.NewFakeRecorder(10))
+			autoscaler.now = func() time.Time { return now }
+
+			if _, err := autoscaler.Reconcile(es); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if test.settleWindow {
+				now = now.Add(10 * time.Minute)
+				if _, err := autoscaler.Reconcile(es); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+
+			if test.pool.Replicas != test.expectReplicas {
+				t.Errorf("expected %d replicas, got %d", test.expectReplicas, test.pool.Replicas)
+			}
+		})
+	}
+}
+
+func TestAutoscalerReconcileDrainsLeavingNodeBeforeScalingDown(t *testing.T) {
+	pool := dataPool(2)
+	nodesStats := esclient.NodesStats{Nodes: map[string]esclient.NodeStats{"n1": nodeStats(10, 10)}}
+
+	esClient := fake.New()
+	esClient.NodesStatsResponse = &nodesStats
+	esClient.CatShardsResponse = []esclient.Shard{{State: "STARTED", Node: "data-1"}}
+
+	es := &v1.ElasticsearchCluster{
+		Spec: v1.ElasticsearchClusterSpec{
+			NodePools: []*v1.ElasticsearchClusterNodePool{pool},
+		},
+	}
+
+	now := time.Unix(0, 0)
+	autoscaler := NewAutoscaler(nil, func(*v1.ElasticsearchCluster) esclient.Interface { return esClient }, record.NewFakeRecorder(10))
+	autoscaler.now = func() time.Time { return now }
+
+	if _, err := autoscaler.Reconcile(es); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now = now.Add(10 * time.Minute)
+	if _, err := autoscaler.Reconcile(es); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pool.Replicas != 2 {
+		t.Errorf("expected node pool not to scale down while the leaving node still holds shards, got %d replicas", pool.Replicas)
+	}
+
+	var excluded bool
+	for _, call := range esClient.Calls {
+		if call.Method == "ExcludeNodeAllocation" && call.Args[0] == "data-1" {
+			excluded = true
+		}
+	}
+	if !excluded {
+		t.Error("expected the leaving node to be excluded from shard allocation before scaling down")
+	}
+
+	esClient.CatShardsResponse = nil
+	if _, err := autoscaler.Reconcile(es); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if pool.Replicas != 1 {
+		t.Errorf("expected node pool to scale down to 1 replica once the leaving node drained, got %d", pool.Replicas)
+	}
+}
+
+func TestVerifyNodePoolRejectsAutoscaledMasters(t *testing.T) {
+	pool := &v1.ElasticsearchClusterNodePool{
+		Roles:       []string{"master"},
+		Autoscaling: &v1.ElasticsearchClusterNodePoolAutoscaling{},
+	}
+
+	if err := verifyNodePool(pool); err == nil {
+		t.Error("expected an error for an autoscaled master node pool, got nil")
+	}
+}
@@ -3,11 +3,11 @@ package elasticsearch
 import (
 	"fmt"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"k8s.io/apimachinery/pkg/api/errors"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	appsinformers "k8s.io/client-go/informers/apps/v1beta1"
@@ -22,18 +22,33 @@ import (
 	apiv1 "k8s.io/client-go/pkg/api/v1"
 	apps "k8s.io/client-go/pkg/apis/apps/v1beta1"
 	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 
 	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
 	"gitlab.jetstack.net/marshal/colonel/pkg/controllers"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
 	informersv1 "gitlab.jetstack.net/marshal/colonel/pkg/informers/v1"
 	listersv1 "gitlab.jetstack.net/marshal/colonel/pkg/listers/v1"
 )
 
+// ESClientFactory builds an esclient.Interface for talking to the cluster
+// managed by the given ElasticsearchCluster. Tests substitute a factory that
+// returns a fake.Client instead of the real HTTP implementation.
+type ESClientFactory func(es *v1.ElasticsearchCluster) esclient.Interface
+
+// defaultESClientFactory returns the real HTTP client, pointed at the
+// in-cluster client Service that NewElasticsearchClusterServiceControl
+// provisions for the cluster.
+func defaultESClientFactory(es *v1.ElasticsearchCluster) esclient.Interface {
+	return esclient.New(fmt.Sprintf("http://%s:9200", clientServiceDNSName(es)))
+}
+
 type ElasticsearchController struct {
 	kubeClient *kubernetes.Clientset
+	esClient   *rest.RESTClient
 
 	esLister       listersv1.ElasticsearchClusterLister
 	esListerSynced cache.InformerSynced
@@ -50,8 +65,21 @@ type ElasticsearchController struct {
 	serviceLister       corelisters.ServiceLister
 	serviceListerSynced cache.InformerSynced
 
+	podLister       corelisters.PodLister
+	podListerSynced cache.InformerSynced
+
 	queue                       workqueue.RateLimitingInterface
 	elasticsearchClusterControl ElasticsearchClusterControl
+	rollingUpgrade              *RollingUpgradeCoordinator
+	autoscaler                  *Autoscaler
+	recorder                    record.EventRecorder
+
+	esClientFactory ESClientFactory
+
+	// healthPollers tracks the stop channel of the per-cluster health
+	// poller goroutine, keyed by "namespace/name".
+	healthPollers   map[string]chan struct{}
+	healthPollersMu sync.Mutex
 }
 
 func NewElasticsearch(
@@ -60,17 +88,30 @@ func NewElasticsearch(
 	statefulsets appsinformers.StatefulSetInformer,
 	serviceaccounts coreinformers.ServiceAccountInformer,
 	services coreinformers.ServiceInformer,
+	pods coreinformers.PodInformer,
 	cl *kubernetes.Clientset,
+	esRESTClient *rest.RESTClient,
+	esClientFactory ESClientFactory,
 ) *ElasticsearchController {
+	if esClientFactory == nil {
+		esClientFactory = defaultESClientFactory
+	}
+
 	eventBroadcaster := record.NewBroadcaster()
 	eventBroadcaster.StartLogging(logrus.Infof)
 	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(cl.Core().RESTClient()).Events("")})
 	recorder := eventBroadcaster.NewRecorder(api.Scheme, apiv1.EventSource{Component: "elasticsearchCluster"})
 
 	elasticsearchController := &ElasticsearchController{
-		kubeClient: cl,
-		queue:      workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "elasticsearchCluster"),
+		kubeClient:      cl,
+		esClient:        esRESTClient,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "elasticsearchCluster"),
+		recorder:        recorder,
+		esClientFactory: esClientFactory,
+		healthPollers:   make(map[string]chan struct{}),
 	}
+	elasticsearchController.rollingUpgrade = NewRollingUpgradeCoordinator(cl, esClientFactory, recorder)
+	elasticsearchController.autoscaler = NewAutoscaler(cl, esClientFactory, recorder)
 
 	es.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: elasticsearchController.enqueueElasticsearchCluster,
@@ -80,7 +121,7 @@ func NewElasticsearch(
 			}
 			elasticsearchController.enqueueElasticsearchCluster(cur)
 		},
-		DeleteFunc: elasticsearchController.enqueueElasticsearchClusterDelete,
+		DeleteFunc: elasticsearchController.enqueueElasticsearchCluster,
 	})
 	elasticsearchController.esLister = es.Lister()
 	elasticsearchController.esListerSynced = es.Informer().HasSynced
@@ -139,6 +180,9 @@ func NewElasticsearch(
 	elasticsearchController.serviceLister = services.Lister()
 	elasticsearchController.serviceListerSynced = services.Informer().HasSynced
 
+	elasticsearchController.podLister = pods.Lister()
+	elasticsearchController.podListerSynced = pods.Informer().HasSynced
+
 	elasticsearchController.elasticsearchClusterControl = NewElasticsearchClusterControl(
 		elasticsearchController.statefulSetLister,
 		elasticsearchController.deployLister,
@@ -177,6 +221,7 @@ func NewElasticsearch(
 				Annotations: map[string]string{"service.alpha.kubernetes.io/tolerate-unready-endpoints": "true"},
 			},
 		),
+		esClientFactory,
 		recorder,
 	)
 
@@ -188,7 +233,7 @@ func (e *ElasticsearchController) Run(workers int, stopCh <-chan struct{}) {
 
 	logrus.Infof("Starting Elasticsearch controller")
 
-	if !cache.WaitForCacheSync(stopCh, e.deployListerSynced, e.esListerSynced, e.statefulSetListerSynced) {
+	if !cache.WaitForCacheSync(stopCh, e.deployListerSynced, e.esListerSynced, e.statefulSetListerSynced, e.podListerSynced) {
 		utilruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 	}
 
@@ -215,19 +260,10 @@ func (e *ElasticsearchController) processNextWorkItem() bool {
 	}
 	defer e.queue.Done(key)
 
-	if k, ok := key.(string); ok {
-		if err := e.sync(k); err != nil {
-			logrus.Infof("Error syncing ElasticsearchCluster %v, requeuing: %v", key.(string), err)
-			e.queue.AddRateLimited(key)
-		} else {
-			e.queue.Forget(key)
-		}
-	} else if es, ok := key.(*v1.ElasticsearchCluster); ok {
-		t := metav1.NewTime(time.Now())
-		es.DeletionTimestamp = &t
-		if err := e.elasticsearchClusterControl.SyncElasticsearchCluster(es); err != nil {
-			logrus.Infof("Error syncing ElasticsearchCluster %v, requeuing: %v", es.Name, err)
-		}
+	if err := e.sync(key.(string)); err != nil {
+		logrus.Infof("Error syncing ElasticsearchCluster %v, requeuing: %v", key, err)
+		e.queue.AddRateLimited(key)
+	} else {
 		e.queue.Forget(key)
 	}
 
@@ -249,6 +285,7 @@ func (e *ElasticsearchController) sync(key string) error {
 	es, err := e.esLister.ElasticsearchClusters(namespace).Get(name)
 	if errors.IsNotFound(err) {
 		logrus.Infof("ElasticsearchCluster has been deleted %v", key)
+		e.stopHealthPoller(namespace, name)
 		return nil
 	}
 	if err != nil {
@@ -256,7 +293,77 @@ func (e *ElasticsearchController) sync(key string) error {
 		return err
 	}
 
-	return e.elasticsearchClusterControl.SyncElasticsearchCluster(es)
+	if es.DeletionTimestamp != nil {
+		return e.syncTeardown(es)
+	}
+
+	if !hasFinalizer(es, elasticsearchClusterFinalizer) {
+		return e.addFinalizer(es)
+	}
+
+	e.ensureHealthPoller(es)
+
+	// Reconcile mutates the node pools and status of its argument, so it must
+	// never be handed the object owned by the informer cache.
+	esCopy := es.DeepCopy()
+	changed := false
+
+	if autoscalerChanged, err := e.autoscaler.Reconcile(esCopy); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error running autoscaler for elasticsearchcluster %v: %v", key, err))
+	} else {
+		changed = changed || autoscalerChanged
+	}
+
+	if pods, err := e.ownedPods(esCopy); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error listing pods for elasticsearchcluster %v: %v", key, err))
+	} else if upgradeChanged, err := e.rollingUpgrade.Reconcile(esCopy, pods); err != nil {
+		utilruntime.HandleError(fmt.Errorf("error running rolling upgrade for elasticsearchcluster %v: %v", key, err))
+	} else {
+		changed = changed || upgradeChanged
+	}
+
+	if changed {
+		// The autoscaler mutates Spec.NodePools[].Replicas as well as
+		// Status.Autoscaler, and the rolling upgrade coordinator mutates
+		// Status.UpgradeProgress; with the status subresource enabled a PUT
+		// to the main resource is not allowed to change status, so both
+		// writes are needed or the status half of these changes is silently
+		// dropped.
+		if err := e.updateElasticsearchCluster(esCopy); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error persisting reconciled spec for elasticsearchcluster %v: %v", key, err))
+		}
+		if err := e.updateElasticsearchClusterStatus(esCopy); err != nil {
+			utilruntime.HandleError(fmt.Errorf("error persisting reconciled status for elasticsearchcluster %v: %v", key, err))
+		}
+	}
+
+	return e.elasticsearchClusterControl.SyncElasticsearchCluster(esCopy)
+}
+
+// updateElasticsearchCluster persists a full copy of es, including its spec,
+// to the apiserver. Callers must pass a DeepCopy of the object they intend to
+// mutate, never the object returned directly by the informer lister.
+func (e *ElasticsearchController) updateElasticsearchCluster(es *v1.ElasticsearchCluster) error {
+	return e.esClient.Put().
+		Namespace(es.Namespace).
+		Resource("elasticsearchclusters").
+		Name(es.Name).
+		Body(es).
+		Do().
+		Error()
+}
+
+// updateElasticsearchClusterStatus persists only the status of a DeepCopy of
+// es to the apiserver.
+func (e *ElasticsearchController) updateElasticsearchClusterStatus(es *v1.ElasticsearchCluster) error {
+	return e.esClient.Put().
+		Namespace(es.Namespace).
+		Resource("elasticsearchclusters").
+		Name(es.Name).
+		SubResource("status").
+		Body(es).
+		Do().
+		Error()
 }
 
 func (e *ElasticsearchController) enqueueElasticsearchCluster(obj interface{}) {
@@ -269,10 +376,6 @@ func (e *ElasticsearchController) enqueueElasticsearchCluster(obj interface{}) {
 	e.queue.Add(key)
 }
 
-func (e *ElasticsearchController) enqueueElasticsearchClusterDelete(obj interface{}) {
-	e.queue.Add(obj)
-}
-
 func (e *ElasticsearchController) handleDeploy(obj interface{}) {
 	var deploy *extensions.Deployment
 	var ok bool
@@ -384,5 +487,13 @@ func verifyNodePool(np *v1.ElasticsearchClusterNodePool) error {
 		}
 	}
 
+	if np.Autoscaling != nil {
+		for _, role := range np.Roles {
+			if role == "master" {
+				return fmt.Errorf("master node pools cannot be autoscaled")
+			}
+		}
+	}
+
 	return nil
 }
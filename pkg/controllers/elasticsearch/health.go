@@ -0,0 +1,206 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+)
+
+// healthPollPeriod is how often the per-cluster health poller queries the
+// managed cluster's REST API when nothing else is driving a resync.
+const healthPollPeriod = 30 * time.Second
+
+// elasticsearchClusterConditionReady is the Status.Conditions entry tracking
+// whether the managed cluster is reporting green health.
+const elasticsearchClusterConditionReady = "Ready"
+
+// handleHealthObservation reconciles a freshly polled /_cluster/health,
+// /_nodes/stats and /_cat/shards response into a DeepCopy of es.Status and
+// fires a k8s Event if the reported health has changed since the last
+// observation. es itself is never mutated, since it is typically the object
+// returned by the informer lister cache; the caller is responsible for
+// persisting the returned copy.
+func (e *ElasticsearchController) handleHealthObservation(es *v1.ElasticsearchCluster, health *esclient.ClusterHealth, nodesStats *esclient.NodesStats, shards []esclient.Shard) *v1.ElasticsearchCluster {
+	esCopy := es.DeepCopy()
+
+	previous := esCopy.Status.Health
+	esCopy.Status.Health = health.Status
+	esCopy.Status.UnassignedShards = health.UnassignedShards
+	esCopy.Status.MasterElected = masterElectedName(nodesStats)
+	esCopy.Status.Nodes = nodeStatuses(nodesStats, shards)
+	setElasticsearchClusterCondition(esCopy, elasticsearchClusterConditionReady, health.Status == "green", "ClusterHealth", fmt.Sprintf("cluster health is %q", health.Status))
+
+	if previous != "" && previous != health.Status {
+		e.recorder.Eventf(es, apiv1.EventTypeNormal, "HealthChanged", "cluster health transitioned from %q to %q", previous, health.Status)
+	}
+
+	return esCopy
+}
+
+// masterElectedName returns the name of the node /_nodes/stats reports as
+// the elected master, or the empty string if none is present.
+func masterElectedName(nodesStats *esclient.NodesStats) string {
+	for _, n := range nodesStats.Nodes {
+		if n.Master {
+			return n.Name
+		}
+	}
+	return ""
+}
+
+// nodeStatuses builds the per-node Status.Nodes entries from a
+// /_nodes/stats response, counting each node's shards from a /_cat/shards
+// listing. nodesStats.Nodes is a map, so entries are sorted by name to give
+// a stable result - otherwise every poll would reorder the slice and churn
+// the object's resourceVersion for no reason.
+func nodeStatuses(nodesStats *esclient.NodesStats, shards []esclient.Shard) []v1.ElasticsearchClusterNodeStatus {
+	shardsByNode := map[string]int32{}
+	for _, shard := range shards {
+		shardsByNode[shard.Node]++
+	}
+
+	var nodes []v1.ElasticsearchClusterNodeStatus
+	for _, n := range nodesStats.Nodes {
+		nodes = append(nodes, v1.ElasticsearchClusterNodeStatus{
+			Name:            n.Name,
+			Master:          n.Master,
+			HeapUsedPercent: n.JVM.Mem.HeapUsedPercent,
+			Shards:          shardsByNode[n.Name],
+		})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+
+	return nodes
+}
+
+// setElasticsearchClusterCondition sets or updates the named condition on
+// es.Status.Conditions, only bumping LastTransitionTime when the status
+// actually changes.
+func setElasticsearchClusterCondition(es *v1.ElasticsearchCluster, conditionType string, ok bool, reason, message string) {
+	status := apiv1.ConditionFalse
+	if ok {
+		status = apiv1.ConditionTrue
+	}
+
+	for i := range es.Status.Conditions {
+		cond := &es.Status.Conditions[i]
+		if cond.Type != conditionType {
+			continue
+		}
+
+		if cond.Status != status {
+			cond.Status = status
+			cond.LastTransitionTime = metav1.Now()
+		}
+		cond.Reason = reason
+		cond.Message = message
+		return
+	}
+
+	es.Status.Conditions = append(es.Status.Conditions, v1.ElasticsearchClusterCondition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	})
+}
+
+// ensureHealthPoller starts a background goroutine that periodically polls
+// the managed cluster's health API and requeues the ElasticsearchCluster,
+// unless one is already running for this cluster.
+func (e *ElasticsearchController) ensureHealthPoller(es *v1.ElasticsearchCluster) {
+	key := es.Namespace + "/" + es.Name
+
+	e.healthPollersMu.Lock()
+	defer e.healthPollersMu.Unlock()
+
+	if _, ok := e.healthPollers[key]; ok {
+		return
+	}
+
+	stopCh := make(chan struct{})
+	e.healthPollers[key] = stopCh
+
+	namespace, name := es.Namespace, es.Name
+	go wait.Until(func() {
+		e.pollClusterHealth(namespace, name)
+	}, healthPollPeriod, stopCh)
+}
+
+// stopHealthPoller stops the health poller goroutine for the given
+// ElasticsearchCluster, if one is running. It is called once the cluster has
+// been deleted.
+func (e *ElasticsearchController) stopHealthPoller(namespace, name string) {
+	key := namespace + "/" + name
+
+	e.healthPollersMu.Lock()
+	defer e.healthPollersMu.Unlock()
+
+	if stopCh, ok := e.healthPollers[key]; ok {
+		close(stopCh)
+		delete(e.healthPollers, key)
+	}
+}
+
+// pollClusterHealth queries the managed cluster's client Service for
+// /_cluster/health, /_nodes/stats and /_cat/shards, persists the result onto
+// Status if it changed, and requeues the cluster so sync can reconcile the
+// rest of its state against the fresh observation.
+func (e *ElasticsearchController) pollClusterHealth(namespace, name string) {
+	es, err := e.esLister.ElasticsearchClusters(namespace).Get(name)
+	if err != nil {
+		logrus.Debugf("stopping health poll for deleted elasticsearchcluster '%s/%s'", namespace, name)
+		e.stopHealthPoller(namespace, name)
+		return
+	}
+
+	esClient := e.esClientFactory(es)
+
+	health, err := esClient.ClusterHealth()
+	if err != nil {
+		logrus.Warnf("error polling cluster health for '%s/%s': %v", namespace, name, err)
+		return
+	}
+
+	nodesStats, err := esClient.NodesStats()
+	if err != nil {
+		logrus.Warnf("error polling nodes stats for '%s/%s': %v", namespace, name, err)
+		return
+	}
+
+	shards, err := esClient.CatShards()
+	if err != nil {
+		logrus.Warnf("error polling shard allocation for '%s/%s': %v", namespace, name, err)
+		return
+	}
+
+	esCopy := e.handleHealthObservation(es, health, nodesStats, shards)
+
+	if !reflect.DeepEqual(es.Status, esCopy.Status) {
+		if err := e.updateElasticsearchClusterStatus(esCopy); err != nil {
+			logrus.Warnf("error persisting health status for '%s/%s': %v", namespace, name, err)
+			return
+		}
+	}
+
+	e.enqueueElasticsearchCluster(esCopy)
+}
+
+// clientServiceDNSName returns the in-cluster DNS name of the client Service
+// that NewElasticsearchClusterServiceControl provisions for this cluster.
+func clientServiceDNSName(es *v1.ElasticsearchCluster) string {
+	return fmt.Sprintf("%s-clients.%s.svc.cluster.local", es.Name, es.Namespace)
+}
@@ -0,0 +1,83 @@
+package elasticsearch
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+)
+
+// Phases of an ElasticsearchSnapshotRestore's lifecycle. syncRestoreResource
+// advances a restore through these in order, persisting Status.Phase after
+// each step so that a crash or requeue never repeats a completed step.
+const (
+	ElasticsearchSnapshotRestorePhasePending   = ""
+	ElasticsearchSnapshotRestorePhaseRestoring = "Restoring"
+	ElasticsearchSnapshotRestorePhaseRestored  = "Restored"
+	ElasticsearchSnapshotRestorePhaseFailed    = "Failed"
+)
+
+// syncRestoreResource drives an ElasticsearchSnapshotRestore to completion:
+// it triggers the restore against the referenced snapshot once, then polls
+// cluster health on subsequent syncs until the restore has settled. Restores
+// that have already reached a terminal phase are a no-op, so re-delivery of
+// an old event can never trigger a duplicate restore.
+func (s *SnapshotController) syncRestoreResource(restore *v1.ElasticsearchSnapshotRestore) error {
+	switch restore.Status.Phase {
+	case ElasticsearchSnapshotRestorePhaseRestored, ElasticsearchSnapshotRestorePhaseFailed:
+		return nil
+	}
+
+	snap, err := s.snapshotLister.ElasticsearchSnapshots(restore.Namespace).Get(restore.Spec.SnapshotName)
+	if err != nil {
+		return s.setRestorePhase(restore, ElasticsearchSnapshotRestorePhaseFailed, fmt.Sprintf("error looking up elasticsearchsnapshot '%s': %s", restore.Spec.SnapshotName, err.Error()))
+	}
+
+	cluster, err := s.esLister.ElasticsearchClusters(restore.Namespace).Get(snap.Spec.ClusterName)
+	if err != nil {
+		return s.setRestorePhase(restore, ElasticsearchSnapshotRestorePhaseFailed, fmt.Sprintf("error looking up elasticsearchcluster '%s': %s", snap.Spec.ClusterName, err.Error()))
+	}
+
+	esClient := s.esClientFactory(cluster)
+
+	if restore.Status.Phase == ElasticsearchSnapshotRestorePhasePending {
+		if err := esClient.RestoreSnapshot(snap.Spec.Repository, snap.Spec.SnapshotName, restore.Spec.Indices); err != nil {
+			return fmt.Errorf("error triggering restore of snapshot '%s': %s", snap.Spec.SnapshotName, err.Error())
+		}
+
+		s.recorder.Eventf(restore, apiv1.EventTypeNormal, "RestoreStarted", "started restore of snapshot '%s'", snap.Spec.SnapshotName)
+
+		return s.setRestorePhase(restore, ElasticsearchSnapshotRestorePhaseRestoring, "")
+	}
+
+	health, err := esClient.ClusterHealth()
+	if err != nil {
+		return fmt.Errorf("error checking cluster health: %s", err.Error())
+	}
+	if health.RelocatingShards > 0 || health.InitializingShards > 0 {
+		return fmt.Errorf("waiting for restore of snapshot '%s' to finish recovering shards", snap.Spec.SnapshotName)
+	}
+
+	s.recorder.Eventf(restore, apiv1.EventTypeNormal, "RestoreCompleted", "completed restore of snapshot '%s'", snap.Spec.SnapshotName)
+
+	return s.setRestorePhase(restore, ElasticsearchSnapshotRestorePhaseRestored, "")
+}
+
+// setRestorePhase persists phase and message onto a DeepCopy of restore's
+// status.
+func (s *SnapshotController) setRestorePhase(restore *v1.ElasticsearchSnapshotRestore, phase, message string) error {
+	restoreCopy := restore.DeepCopy()
+	restoreCopy.Status.Phase = phase
+	restoreCopy.Status.Message = message
+
+	return s.esClient.Put().
+		Namespace(restoreCopy.Namespace).
+		Resource("elasticsearchsnapshotrestores").
+		Name(restoreCopy.Name).
+		SubResource("status").
+		Body(restoreCopy).
+		Do().
+		Error()
+}
@@ -0,0 +1,483 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/gorhill/cronexpr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+	"gitlab.jetstack.net/marshal/colonel/pkg/controllers"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+	informersv1 "gitlab.jetstack.net/marshal/colonel/pkg/informers/v1"
+	listersv1 "gitlab.jetstack.net/marshal/colonel/pkg/listers/v1"
+)
+
+// navigatorAPIVersion is the apiVersion of the navigator.jetstack.io CRDs
+// that this controller manages, used when constructing OwnerReferences by
+// hand rather than via metav1.NewControllerRef against a typed object.
+const navigatorAPIVersion = "navigator.jetstack.io/v1"
+
+// SnapshotController reconciles ElasticsearchSnapshot and
+// ElasticsearchSnapshotSchedule resources: it registers a snapshot
+// repository with the managed cluster, takes snapshots on a cron schedule,
+// garbage-collects old snapshots per a retention policy, and services
+// on-demand ElasticsearchSnapshotRestore CRs.
+type SnapshotController struct {
+	kubeClient *kubernetes.Clientset
+	esClient   *rest.RESTClient
+
+	esLister       listersv1.ElasticsearchClusterLister
+	esListerSynced cache.InformerSynced
+
+	scheduleLister       listersv1.ElasticsearchSnapshotScheduleLister
+	scheduleListerSynced cache.InformerSynced
+
+	snapshotLister       listersv1.ElasticsearchSnapshotLister
+	snapshotListerSynced cache.InformerSynced
+
+	restoreLister       listersv1.ElasticsearchSnapshotRestoreLister
+	restoreListerSynced cache.InformerSynced
+
+	secretLister corelisters.SecretLister
+
+	esClientFactory ESClientFactory
+
+	queue        workqueue.RateLimitingInterface
+	restoreQueue workqueue.RateLimitingInterface
+	recorder     record.EventRecorder
+}
+
+// NewSnapshotController returns a SnapshotController wired up to the given
+// informers, following the same construction pattern as NewElasticsearch.
+func NewSnapshotController(
+	es informersv1.ElasticsearchClusterInformer,
+	schedules informersv1.ElasticsearchSnapshotScheduleInformer,
+	snapshots informersv1.ElasticsearchSnapshotInformer,
+	restores informersv1.ElasticsearchSnapshotRestoreInformer,
+	secrets corelisters.SecretLister,
+	cl *kubernetes.Clientset,
+	esRESTClient *rest.RESTClient,
+	esClientFactory ESClientFactory,
+) *SnapshotController {
+	if esClientFactory == nil {
+		esClientFactory = defaultESClientFactory
+	}
+
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(logrus.Infof)
+	eventBroadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: v1core.New(cl.Core().RESTClient()).Events("")})
+	recorder := eventBroadcaster.NewRecorder(api.Scheme, apiv1.EventSource{Component: "elasticsearchSnapshot"})
+
+	s := &SnapshotController{
+		kubeClient:      cl,
+		esClient:        esRESTClient,
+		secretLister:    secrets,
+		esClientFactory: esClientFactory,
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "elasticsearchSnapshot"),
+		recorder:        recorder,
+	}
+
+	es.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{})
+	s.esLister = es.Lister()
+	s.esListerSynced = es.Informer().HasSynced
+
+	schedules.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.enqueueSchedule,
+		UpdateFunc: func(old, cur interface{}) {
+			if reflect.DeepEqual(old, cur) {
+				return
+			}
+			s.enqueueSchedule(cur)
+		},
+		DeleteFunc: s.enqueueSchedule,
+	})
+	s.scheduleLister = schedules.Lister()
+	s.scheduleListerSynced = schedules.Informer().HasSynced
+
+	snapshots.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.enqueueSnapshot,
+		UpdateFunc: func(old, cur interface{}) {
+			if reflect.DeepEqual(old, cur) {
+				return
+			}
+			s.enqueueSnapshot(cur)
+		},
+	})
+	s.snapshotLister = snapshots.Lister()
+	s.snapshotListerSynced = snapshots.Informer().HasSynced
+
+	s.restoreQueue = workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "elasticsearchSnapshotRestore")
+	restores.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: s.enqueueRestore,
+		UpdateFunc: func(old, cur interface{}) {
+			if reflect.DeepEqual(old, cur) {
+				return
+			}
+			s.enqueueRestore(cur)
+		},
+	})
+	s.restoreLister = restores.Lister()
+	s.restoreListerSynced = restores.Informer().HasSynced
+
+	return s
+}
+
+func (s *SnapshotController) Run(workers int, stopCh <-chan struct{}) {
+	defer s.queue.ShutDown()
+	defer s.restoreQueue.ShutDown()
+
+	logrus.Infof("Starting Elasticsearch snapshot controller")
+
+	if !cache.WaitForCacheSync(stopCh, s.esListerSynced, s.scheduleListerSynced, s.snapshotListerSynced, s.restoreListerSynced) {
+		utilruntime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+	}
+
+	for i := 0; i < workers; i++ {
+		go wait.Until(s.worker, time.Second, stopCh)
+		go wait.Until(s.restoreWorker, time.Second, stopCh)
+	}
+
+	<-stopCh
+	logrus.Infof("Shutting down Elasticsearch snapshot controller")
+}
+
+func (s *SnapshotController) worker() {
+	for s.processNextWorkItem() {
+	}
+}
+
+func (s *SnapshotController) processNextWorkItem() bool {
+	key, quit := s.queue.Get()
+	if quit {
+		return false
+	}
+	defer s.queue.Done(key)
+
+	if err := s.sync(key.(string)); err != nil {
+		logrus.Infof("Error syncing elasticsearchsnapshotschedule %v, requeuing: %v", key, err)
+		s.queue.AddRateLimited(key)
+	} else {
+		s.queue.Forget(key)
+	}
+
+	return true
+}
+
+func (s *SnapshotController) sync(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	schedule, err := s.scheduleLister.ElasticsearchSnapshotSchedules(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		logrus.Infof("ElasticsearchSnapshotSchedule has been deleted %v", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.syncSchedule(schedule)
+}
+
+// syncSchedule registers the snapshot repository if necessary, and takes a
+// new snapshot if the schedule's cron expression has elapsed since the last
+// recorded snapshot. It then garbage-collects snapshots beyond the
+// configured retention policy.
+func (s *SnapshotController) syncSchedule(schedule *v1.ElasticsearchSnapshotSchedule) error {
+	cluster, err := s.esLister.ElasticsearchClusters(schedule.Namespace).Get(schedule.Spec.ClusterName)
+	if err != nil {
+		return fmt.Errorf("error looking up elasticsearchcluster '%s' for snapshot schedule '%s': %s", schedule.Spec.ClusterName, schedule.Name, err.Error())
+	}
+
+	if err := s.ensureRepository(cluster, schedule); err != nil {
+		return fmt.Errorf("error ensuring snapshot repository: %s", err.Error())
+	}
+
+	expr, err := cronexpr.Parse(schedule.Spec.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid cron schedule %q: %s", schedule.Spec.Schedule, err.Error())
+	}
+
+	if schedule.Status.LastSnapshotTime == nil || expr.Next(schedule.Status.LastSnapshotTime.Time).Before(time.Now()) {
+		if err := s.takeSnapshot(cluster, schedule); err != nil {
+			return fmt.Errorf("error taking snapshot: %s", err.Error())
+		}
+
+		scheduleCopy := schedule.DeepCopy()
+		now := metav1.Now()
+		scheduleCopy.Status.LastSnapshotTime = &now
+		if err := s.updateScheduleStatus(scheduleCopy); err != nil {
+			return fmt.Errorf("error recording last snapshot time: %s", err.Error())
+		}
+		schedule = scheduleCopy
+	}
+
+	return s.garbageCollect(cluster, schedule)
+}
+
+// updateScheduleStatus persists only the status of a DeepCopy of schedule to
+// the apiserver.
+func (s *SnapshotController) updateScheduleStatus(schedule *v1.ElasticsearchSnapshotSchedule) error {
+	return s.esClient.Put().
+		Namespace(schedule.Namespace).
+		Resource("elasticsearchsnapshotschedules").
+		Name(schedule.Name).
+		SubResource("status").
+		Body(schedule).
+		Do().
+		Error()
+}
+
+func (s *SnapshotController) ensureRepository(cluster *v1.ElasticsearchCluster, schedule *v1.ElasticsearchSnapshotSchedule) error {
+	secret, err := s.secretLister.Secrets(schedule.Namespace).Get(schedule.Spec.Repository.SecretName)
+	if err != nil {
+		return fmt.Errorf("error loading repository secret '%s': %s", schedule.Spec.Repository.SecretName, err.Error())
+	}
+
+	return s.esClientFactory(cluster).CreateSnapshotRepository(schedule.Spec.Repository.Name, esclient.SnapshotRepository{
+		Type:     schedule.Spec.Repository.Type,
+		Settings: repositorySettings(schedule.Spec.Repository, secret),
+	})
+}
+
+// repositorySettings builds the repository settings document by copying
+// every key of the repository Secret's data verbatim, as a string value.
+// repo.Type is not consulted: no backend-specific renaming or translation of
+// keys is done for any repository plugin.
+func repositorySettings(repo v1.ElasticsearchSnapshotRepository, secret *apiv1.Secret) map[string]interface{} {
+	settings := map[string]interface{}{}
+	for k, v := range secret.Data {
+		settings[k] = string(v)
+	}
+	return settings
+}
+
+func (s *SnapshotController) takeSnapshot(cluster *v1.ElasticsearchCluster, schedule *v1.ElasticsearchSnapshotSchedule) error {
+	name := fmt.Sprintf("%s-%d", schedule.Name, time.Now().Unix())
+
+	if err := s.esClientFactory(cluster).CreateSnapshot(schedule.Spec.Repository.Name, name); err != nil {
+		return err
+	}
+
+	if err := s.createSnapshotCR(schedule, name); err != nil {
+		return fmt.Errorf("error recording elasticsearchsnapshot '%s': %s", name, err.Error())
+	}
+
+	s.recorder.Eventf(schedule, apiv1.EventTypeNormal, "SnapshotCreated", "created snapshot '%s' in repository '%s'", name, schedule.Spec.Repository.Name)
+
+	return nil
+}
+
+// createSnapshotCR records a snapshot taken against the managed cluster as
+// an ElasticsearchSnapshot CR, owned by schedule. garbageCollect relies on
+// this CR existing to enforce the schedule's retention policy and on-demand
+// Restores reference it by name.
+func (s *SnapshotController) createSnapshotCR(schedule *v1.ElasticsearchSnapshotSchedule, name string) error {
+	snap := &v1.ElasticsearchSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       schedule.Namespace,
+			OwnerReferences: []metav1.OwnerReference{newScheduleOwnerReference(schedule)},
+		},
+		Spec: v1.ElasticsearchSnapshotSpec{
+			ClusterName:  schedule.Spec.ClusterName,
+			Repository:   schedule.Spec.Repository.Name,
+			SnapshotName: name,
+		},
+	}
+
+	return s.esClient.Post().
+		Namespace(schedule.Namespace).
+		Resource("elasticsearchsnapshots").
+		Body(snap).
+		Do().
+		Error()
+}
+
+// newScheduleOwnerReference builds the OwnerReference that
+// managedScheduleOwnerRef looks for, pointing at schedule.
+func newScheduleOwnerReference(schedule *v1.ElasticsearchSnapshotSchedule) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion: navigatorAPIVersion,
+		Kind:       "ElasticsearchSnapshotSchedule",
+		Name:       schedule.Name,
+		UID:        schedule.UID,
+		Controller: &controller,
+	}
+}
+
+// garbageCollect removes snapshots beyond the schedule's retention policy.
+// At most one of KeepLast and KeepWithin is expected to be set.
+func (s *SnapshotController) garbageCollect(cluster *v1.ElasticsearchCluster, schedule *v1.ElasticsearchSnapshotSchedule) error {
+	snapshots, err := s.snapshotLister.ElasticsearchSnapshots(schedule.Namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var owned []*v1.ElasticsearchSnapshot
+	for _, snap := range snapshots {
+		if ownerRef := managedScheduleOwnerRef(snap.ObjectMeta); ownerRef != nil && ownerRef.Name == schedule.Name {
+			owned = append(owned, snap)
+		}
+	}
+
+	retention := schedule.Spec.Retention
+	switch {
+	case retention.KeepLast > 0 && len(owned) > int(retention.KeepLast):
+		// snapshotLister.List returns results in no particular order; sort
+		// oldest-first so the slice below drops the oldest snapshots rather
+		// than an arbitrary, possibly-newest, subset.
+		sort.Slice(owned, func(i, j int) bool {
+			return owned[i].CreationTimestamp.Time.Before(owned[j].CreationTimestamp.Time)
+		})
+		for _, snap := range owned[:len(owned)-int(retention.KeepLast)] {
+			if err := s.deleteSnapshot(cluster, schedule, snap); err != nil {
+				return err
+			}
+		}
+	case retention.KeepWithin != nil:
+		cutoff := time.Now().Add(-retention.KeepWithin.Duration)
+		for _, snap := range owned {
+			if snap.CreationTimestamp.Time.Before(cutoff) {
+				if err := s.deleteSnapshot(cluster, schedule, snap); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// deleteSnapshot deletes the Elasticsearch snapshot and its owning
+// ElasticsearchSnapshot CR. The snapshot delete tolerates the snapshot
+// already being gone (e.g. a previous pass succeeded against Elasticsearch
+// but failed to remove the CR) so garbageCollect always makes progress
+// towards dropping snap from snapshotLister, instead of retrying the same
+// 404 forever.
+func (s *SnapshotController) deleteSnapshot(cluster *v1.ElasticsearchCluster, schedule *v1.ElasticsearchSnapshotSchedule, snap *v1.ElasticsearchSnapshot) error {
+	if err := s.esClientFactory(cluster).DeleteSnapshot(schedule.Spec.Repository.Name, snap.Spec.SnapshotName); err != nil && !esclient.IsNotFound(err) {
+		return fmt.Errorf("error deleting snapshot '%s': %s", snap.Spec.SnapshotName, err.Error())
+	}
+
+	if err := s.esClient.Delete().
+		Namespace(snap.Namespace).
+		Resource("elasticsearchsnapshots").
+		Name(snap.Name).
+		Do().
+		Error(); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting elasticsearchsnapshot '%s': %s", snap.Name, err.Error())
+	}
+
+	s.recorder.Eventf(schedule, apiv1.EventTypeNormal, "SnapshotDeleted", "deleted snapshot '%s' past retention policy", snap.Spec.SnapshotName)
+
+	return nil
+}
+
+// managedScheduleOwnerRef returns the OwnerReference pointing at the
+// ElasticsearchSnapshotSchedule that owns obj, if any. It mirrors
+// managedOwnerRef's lookup for the ElasticsearchCluster kind.
+func managedScheduleOwnerRef(obj metav1.ObjectMeta) *metav1.OwnerReference {
+	for i := range obj.OwnerReferences {
+		ref := &obj.OwnerReferences[i]
+		if ref.Kind == "ElasticsearchSnapshotSchedule" {
+			return ref
+		}
+	}
+	return nil
+}
+
+func (s *SnapshotController) enqueueSchedule(obj interface{}) {
+	key, err := controllers.KeyFunc(obj)
+	if err != nil {
+		logrus.Infof("Cound't get key for object %+v: %v", obj, err)
+		return
+	}
+	s.queue.Add(key)
+}
+
+func (s *SnapshotController) restoreWorker() {
+	for s.processNextRestoreWorkItem() {
+	}
+}
+
+func (s *SnapshotController) processNextRestoreWorkItem() bool {
+	key, quit := s.restoreQueue.Get()
+	if quit {
+		return false
+	}
+	defer s.restoreQueue.Done(key)
+
+	if err := s.syncRestore(key.(string)); err != nil {
+		logrus.Infof("Error syncing elasticsearchsnapshotrestore %v, requeuing: %v", key, err)
+		s.restoreQueue.AddRateLimited(key)
+	} else {
+		s.restoreQueue.Forget(key)
+	}
+
+	return true
+}
+
+func (s *SnapshotController) syncRestore(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	restore, err := s.restoreLister.ElasticsearchSnapshotRestores(namespace).Get(name)
+	if errors.IsNotFound(err) {
+		logrus.Infof("ElasticsearchSnapshotRestore has been deleted %v", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.syncRestoreResource(restore)
+}
+
+func (s *SnapshotController) enqueueRestore(obj interface{}) {
+	key, err := controllers.KeyFunc(obj)
+	if err != nil {
+		logrus.Infof("Cound't get key for object %+v: %v", obj, err)
+		return
+	}
+	s.restoreQueue.Add(key)
+}
+
+func (s *SnapshotController) enqueueSnapshot(obj interface{}) {
+	snap, ok := obj.(*v1.ElasticsearchSnapshot)
+	if !ok {
+		logrus.Errorf("error decoding elasticsearchsnapshot, invalid type")
+		return
+	}
+	if ownerRef := managedScheduleOwnerRef(snap.ObjectMeta); ownerRef != nil {
+		schedule, err := s.scheduleLister.ElasticsearchSnapshotSchedules(snap.Namespace).Get(ownerRef.Name)
+		if err != nil {
+			logrus.Infof("ignoring orphaned elasticsearchsnapshot '%s' of schedule '%s'", snap.Name, ownerRef.Name)
+			return
+		}
+		s.enqueueSchedule(schedule)
+	}
+}
@@ -0,0 +1,267 @@
+package elasticsearch
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	apps "k8s.io/client-go/pkg/apis/apps/v1beta1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	extensions "k8s.io/client-go/pkg/apis/extensions/v1beta1"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+)
+
+// elasticsearchClusterFinalizer is added to every ElasticsearchCluster on
+// first observation, and removed only once syncTeardown has finished
+// quiescing and deleting all of the cluster's owned resources. This lets
+// deletion coordinate with dependent resources instead of the controller
+// losing track of the object after a single reconcile pass.
+const elasticsearchClusterFinalizer = "elasticsearchcluster.navigator.jetstack.io/teardown"
+
+func hasFinalizer(es *v1.ElasticsearchCluster, name string) bool {
+	for _, f := range es.Finalizers {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addFinalizer persists elasticsearchClusterFinalizer onto es so that a
+// subsequent deletion is routed through syncTeardown instead of being
+// dropped from the informer cache immediately.
+func (e *ElasticsearchController) addFinalizer(es *v1.ElasticsearchCluster) error {
+	esCopy := es.DeepCopy()
+	esCopy.Finalizers = append(esCopy.Finalizers, elasticsearchClusterFinalizer)
+
+	return e.esClient.Put().
+		Namespace(esCopy.Namespace).
+		Resource("elasticsearchclusters").
+		Name(esCopy.Name).
+		Body(esCopy).
+		Do().
+		Error()
+}
+
+func (e *ElasticsearchController) removeFinalizer(es *v1.ElasticsearchCluster) error {
+	esCopy := es.DeepCopy()
+
+	finalizers := esCopy.Finalizers[:0]
+	for _, f := range esCopy.Finalizers {
+		if f != elasticsearchClusterFinalizer {
+			finalizers = append(finalizers, f)
+		}
+	}
+	esCopy.Finalizers = finalizers
+
+	return e.esClient.Put().
+		Namespace(esCopy.Namespace).
+		Resource("elasticsearchclusters").
+		Name(esCopy.Name).
+		Body(esCopy).
+		Do().
+		Error()
+}
+
+// syncTeardown runs the finalizer handler for an ElasticsearchCluster that
+// has a DeletionTimestamp set: it quiesces ingest, optionally takes a final
+// snapshot, deletes the owned resources in dependency order, and only then
+// removes the finalizer so the apiserver can garbage collect the object.
+// Cluster health is checked, and green awaited before deleting anything,
+// only when a final snapshot is configured; otherwise health is not checked.
+func (e *ElasticsearchController) syncTeardown(es *v1.ElasticsearchCluster) error {
+	if !hasFinalizer(es, elasticsearchClusterFinalizer) {
+		return nil
+	}
+
+	if err := e.quiesceClientPools(es); err != nil {
+		return fmt.Errorf("error quiescing client node pools: %s", err.Error())
+	}
+
+	if es.Spec.Teardown != nil && es.Spec.Teardown.FinalSnapshot && es.Spec.Teardown.Repository != "" {
+		esClient := e.esClientFactory(es)
+
+		if !es.Status.FinalSnapshotTaken {
+			if err := esClient.CreateSnapshot(es.Spec.Teardown.Repository, fmt.Sprintf("%s-final", es.Name)); err != nil {
+				return fmt.Errorf("error taking final snapshot: %s", err.Error())
+			}
+
+			esCopy := es.DeepCopy()
+			esCopy.Status.FinalSnapshotTaken = true
+			if err := e.updateElasticsearchClusterStatus(esCopy); err != nil {
+				return fmt.Errorf("error recording final snapshot taken: %s", err.Error())
+			}
+			es = esCopy
+		}
+
+		health, err := esClient.ClusterHealth()
+		if err != nil || health.Status != "green" {
+			return fmt.Errorf("waiting for cluster to reach green health before deleting resources")
+		}
+	}
+
+	if err := e.deleteOwnedResources(es); err != nil {
+		return fmt.Errorf("error deleting owned resources: %s", err.Error())
+	}
+
+	e.stopHealthPoller(es.Namespace, es.Name)
+
+	if err := e.removeFinalizer(es); err != nil {
+		return fmt.Errorf("error removing finalizer: %s", err.Error())
+	}
+
+	logrus.Infof("finished tearing down elasticsearchcluster '%s/%s'", es.Namespace, es.Name)
+
+	return nil
+}
+
+func (e *ElasticsearchController) ownedDeploys(es *v1.ElasticsearchCluster) ([]*extensions.Deployment, error) {
+	all, err := e.deployLister.Deployments(es.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*extensions.Deployment
+	for _, deploy := range all {
+		if ownerRef := managedOwnerRef(deploy.ObjectMeta); ownerRef != nil && ownerRef.Name == es.Name {
+			owned = append(owned, deploy)
+		}
+	}
+
+	return owned, nil
+}
+
+func (e *ElasticsearchController) ownedStatefulSets(es *v1.ElasticsearchCluster) ([]*apps.StatefulSet, error) {
+	all, err := e.statefulSetLister.StatefulSets(es.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*apps.StatefulSet
+	for _, ss := range all {
+		if ownerRef := managedOwnerRef(ss.ObjectMeta); ownerRef != nil && ownerRef.Name == es.Name {
+			owned = append(owned, ss)
+		}
+	}
+
+	return owned, nil
+}
+
+func (e *ElasticsearchController) ownedServices(es *v1.ElasticsearchCluster) ([]*apiv1.Service, error) {
+	all, err := e.serviceLister.Services(es.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*apiv1.Service
+	for _, svc := range all {
+		if ownerRef := managedOwnerRef(svc.ObjectMeta); ownerRef != nil && ownerRef.Name == es.Name {
+			owned = append(owned, svc)
+		}
+	}
+
+	return owned, nil
+}
+
+func (e *ElasticsearchController) ownedPods(es *v1.ElasticsearchCluster) ([]*apiv1.Pod, error) {
+	all, err := e.podLister.Pods(es.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*apiv1.Pod
+	for _, pod := range all {
+		if ownerRef := managedOwnerRef(pod.ObjectMeta); ownerRef != nil && ownerRef.Name == es.Name {
+			owned = append(owned, pod)
+		}
+	}
+
+	return owned, nil
+}
+
+func (e *ElasticsearchController) ownedServiceAccounts(es *v1.ElasticsearchCluster) ([]*apiv1.ServiceAccount, error) {
+	all, err := e.serviceAccountLister.ServiceAccounts(es.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*apiv1.ServiceAccount
+	for _, sa := range all {
+		if ownerRef := managedOwnerRef(sa.ObjectMeta); ownerRef != nil && ownerRef.Name == es.Name {
+			owned = append(owned, sa)
+		}
+	}
+
+	return owned, nil
+}
+
+// quiesceClientPools scales every client node pool's Deployment to zero
+// replicas so no new requests are accepted while the rest of teardown runs.
+func (e *ElasticsearchController) quiesceClientPools(es *v1.ElasticsearchCluster) error {
+	deploys, err := e.ownedDeploys(es)
+	if err != nil {
+		return err
+	}
+
+	var zero int32
+	for _, deploy := range deploys {
+		deployCopy := deploy.DeepCopy()
+		deployCopy.Spec.Replicas = &zero
+		if _, err := e.kubeClient.Extensions().Deployments(es.Namespace).Update(deployCopy); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteOwnedResources deletes the StatefulSets, Deployments, Services and
+// ServiceAccounts owned by es, in dependency order: StatefulSets and
+// Deployments first so Elasticsearch processes stop, then the Services
+// fronting them, and finally the ServiceAccounts they ran as.
+func (e *ElasticsearchController) deleteOwnedResources(es *v1.ElasticsearchCluster) error {
+	statefulSets, err := e.ownedStatefulSets(es)
+	if err != nil {
+		return err
+	}
+	for _, ss := range statefulSets {
+		if err := e.kubeClient.AppsV1beta1().StatefulSets(es.Namespace).Delete(ss.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	deploys, err := e.ownedDeploys(es)
+	if err != nil {
+		return err
+	}
+	for _, deploy := range deploys {
+		if err := e.kubeClient.Extensions().Deployments(es.Namespace).Delete(deploy.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	services, err := e.ownedServices(es)
+	if err != nil {
+		return err
+	}
+	for _, svc := range services {
+		if err := e.kubeClient.Core().Services(es.Namespace).Delete(svc.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	serviceAccounts, err := e.ownedServiceAccounts(es)
+	if err != nil {
+		return err
+	}
+	for _, sa := range serviceAccounts {
+		if err := e.kubeClient.Core().ServiceAccounts(es.Namespace).Delete(sa.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,218 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+)
+
+const (
+	// UpdateStrategyOnDelete leaves rotation of pods to whoever deletes
+	// them - the controller will not touch pods itself.
+	UpdateStrategyOnDelete = "OnDelete"
+	// UpdateStrategyRollingUpdate performs the shard-aware rolling
+	// restart procedure implemented by RollingUpgradeCoordinator.
+	UpdateStrategyRollingUpdate = "RollingUpdate"
+	// UpdateStrategyManual pauses the coordinator entirely, requiring an
+	// operator to roll pods by hand.
+	UpdateStrategyManual = "Manual"
+)
+
+// elasticsearchClusterVersionLabel is stamped by the node pool controllers
+// onto every pod they create, and is compared against Spec.Version to tell
+// which pods are still running an old version.
+const elasticsearchClusterVersionLabel = "elasticsearchcluster.navigator.jetstack.io/version"
+
+// RollingUpgradeCoordinator implements the Elasticsearch-recommended rolling
+// restart procedure: disable shard allocation, flush, delete a single pod,
+// then wait for the cluster to return to green before re-enabling allocation
+// and moving on to the next pod. Reconcile is invoked from sync() on every
+// resync; waiting for green never blocks a worker goroutine - it is spread
+// across reconciles via es.Status.UpgradeProgress.RollingPod, which records
+// the pod a previous call is still waiting on.
+type RollingUpgradeCoordinator struct {
+	kubeClient      *kubernetes.Clientset
+	esClientFactory ESClientFactory
+	recorder        record.EventRecorder
+}
+
+// NewRollingUpgradeCoordinator returns a RollingUpgradeCoordinator.
+func NewRollingUpgradeCoordinator(cl *kubernetes.Clientset, esClientFactory ESClientFactory, recorder record.EventRecorder) *RollingUpgradeCoordinator {
+	return &RollingUpgradeCoordinator{
+		kubeClient:      cl,
+		esClientFactory: esClientFactory,
+		recorder:        recorder,
+	}
+}
+
+// Reconcile compares pods against es.Spec.Version and, if any are outdated,
+// makes one unit of rollout progress: non-master node pools are rolled
+// before master pools, and within a pool pods are rolled in name order, one
+// at a time. It maintains es.Status.UpgradeProgress and reports whether it
+// changed es, so the caller knows whether the result needs persisting.
+func (r *RollingUpgradeCoordinator) Reconcile(es *v1.ElasticsearchCluster, pods []*apiv1.Pod) (bool, error) {
+	if es.Spec.UpdateStrategy == UpdateStrategyManual || es.Spec.UpdateStrategy == UpdateStrategyOnDelete {
+		return false, nil
+	}
+
+	esClient := r.esClientFactory(es)
+
+	if es.Status.UpgradeProgress != nil && es.Status.UpgradeProgress.RollingPod != "" {
+		return r.finishRoll(es, esClient)
+	}
+
+	var total, rolled int32
+	var nextPool *v1.ElasticsearchClusterNodePool
+	var nextPod string
+
+	for _, pool := range orderedForRollout(es.Spec.NodePools) {
+		poolPods := podsInPool(pool, pods)
+		outdated := outdatedPodNames(poolPods, es.Spec.Version)
+
+		total += int32(len(poolPods))
+		rolled += int32(len(poolPods) - len(outdated))
+
+		if nextPod == "" && len(outdated) > 0 {
+			nextPool = pool
+			nextPod = outdated[0]
+		}
+	}
+
+	if nextPod == "" {
+		if es.Status.UpgradeProgress == nil {
+			return false, nil
+		}
+		es.Status.UpgradeProgress = nil
+		return true, nil
+	}
+
+	if err := r.startRoll(es, esClient, nextPod); err != nil {
+		return false, fmt.Errorf("error rolling pod '%s' in node pool '%s': %s", nextPod, nextPool.Name, err.Error())
+	}
+
+	es.Status.UpgradeProgress = &v1.ElasticsearchClusterUpgradeStatus{
+		Pool:       nextPool.Name,
+		RollingPod: nextPod,
+		RolledPods: rolled,
+		TotalPods:  total,
+	}
+
+	return true, nil
+}
+
+// orderedForRollout returns pools with master pools moved to the end, so
+// masters are always rolled last and one at a time, never risking quorum
+// while other node pools are still catching up.
+func orderedForRollout(pools []*v1.ElasticsearchClusterNodePool) []*v1.ElasticsearchClusterNodePool {
+	var nonMasters, masters []*v1.ElasticsearchClusterNodePool
+	for _, pool := range pools {
+		if isMasterPool(pool) {
+			masters = append(masters, pool)
+		} else {
+			nonMasters = append(nonMasters, pool)
+		}
+	}
+	return append(nonMasters, masters...)
+}
+
+func isMasterPool(pool *v1.ElasticsearchClusterNodePool) bool {
+	for _, role := range pool.Roles {
+		if role == "master" {
+			return true
+		}
+	}
+	return false
+}
+
+func podsInPool(pool *v1.ElasticsearchClusterNodePool, pods []*apiv1.Pod) []*apiv1.Pod {
+	var matched []*apiv1.Pod
+	for _, pod := range pods {
+		if strings.HasPrefix(pod.Name, pool.Name+"-") {
+			matched = append(matched, pod)
+		}
+	}
+	return matched
+}
+
+// outdatedPodNames returns the names of poolPods whose version label doesn't
+// match version, sorted so rollout order is deterministic.
+func outdatedPodNames(poolPods []*apiv1.Pod, version string) []string {
+	var names []string
+	for _, pod := range poolPods {
+		if pod.Labels[elasticsearchClusterVersionLabel] != version {
+			names = append(names, pod.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// startRoll disables shard allocation, flushes, and deletes podName. It does
+// not wait for the cluster to recover: the caller records podName on
+// es.Status.UpgradeProgress.RollingPod so finishRoll can pick up waiting for
+// green on a later, independent reconcile instead of blocking this one.
+// Allocation is re-enabled immediately if a step before the pod delete
+// fails, since in that case no further reconcile will come along to do it.
+func (r *RollingUpgradeCoordinator) startRoll(es *v1.ElasticsearchCluster, esClient esclient.Interface, podName string) error {
+	if err := esClient.PutClusterSettings(esclient.ClusterSettings{
+		Transient: map[string]interface{}{"cluster.routing.allocation.enable": "none"},
+	}); err != nil {
+		return fmt.Errorf("error disabling shard allocation: %s", err.Error())
+	}
+
+	if err := esClient.SyncedFlush(); err != nil {
+		r.reenableAllocation(esClient)
+		return fmt.Errorf("error performing synced flush: %s", err.Error())
+	}
+
+	if err := r.kubeClient.Core().Pods(es.Namespace).Delete(podName, &metav1.DeleteOptions{}); err != nil {
+		r.reenableAllocation(esClient)
+		return fmt.Errorf("error deleting pod '%s': %s", podName, err.Error())
+	}
+
+	return nil
+}
+
+// finishRoll checks whether the cluster has returned to green since
+// startRoll deleted es.Status.UpgradeProgress.RollingPod and, if so,
+// re-enables shard allocation and clears RollingPod so Reconcile moves on to
+// the next outdated pod. If the cluster isn't green yet it reports no
+// change, and the caller is expected to retry on the next reconcile rather
+// than block waiting here.
+func (r *RollingUpgradeCoordinator) finishRoll(es *v1.ElasticsearchCluster, esClient esclient.Interface) (bool, error) {
+	health, err := esClient.ClusterHealth()
+	if err != nil {
+		return false, fmt.Errorf("error checking cluster health: %s", err.Error())
+	}
+	if health.Status != "green" {
+		logrus.Debugf("cluster '%s/%s' not yet green, still waiting to finish rolling pod '%s'", es.Namespace, es.Name, es.Status.UpgradeProgress.RollingPod)
+		return false, nil
+	}
+
+	if err := r.reenableAllocation(esClient); err != nil {
+		return false, fmt.Errorf("error re-enabling shard allocation: %s", err.Error())
+	}
+
+	podName, pool := es.Status.UpgradeProgress.RollingPod, es.Status.UpgradeProgress.Pool
+	es.Status.UpgradeProgress.RollingPod = ""
+	es.Status.UpgradeProgress.RolledPods++
+
+	r.recorder.Eventf(es, apiv1.EventTypeNormal, "PodRolled", "rolled pod '%s' in node pool '%s'", podName, pool)
+
+	return true, nil
+}
+
+func (r *RollingUpgradeCoordinator) reenableAllocation(esClient esclient.Interface) error {
+	return esClient.PutClusterSettings(esclient.ClusterSettings{
+		Transient: map[string]interface{}{"cluster.routing.allocation.enable": "all"},
+	})
+}
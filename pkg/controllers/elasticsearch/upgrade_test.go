@@ -0,0 +1,162 @@
+package elasticsearch
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apiv1 "k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+
+	"gitlab.jetstack.net/marshal/colonel/pkg/api/v1"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient/fake"
+)
+
+func TestRollingUpgradeCoordinatorHonorsPausedStrategies(t *testing.T) {
+	tests := map[string]string{
+		"does not roll pods when paused for manual intervention": UpdateStrategyManual,
+		"does not roll pods when rotation is left to whoever deletes them": UpdateStrategyOnDelete,
+	}
+
+	for name, strategy := range tests {
+		t.Run(name, func(t *testing.T) {
+			esClient := fake.New()
+
+			es := &v1.ElasticsearchCluster{
+				Spec: v1.ElasticsearchClusterSpec{
+					UpdateStrategy: strategy,
+					Version:        "6.2.0",
+					NodePools:      []*v1.ElasticsearchClusterNodePool{dataPool(2)},
+				},
+			}
+			pods := []*apiv1.Pod{
+				outdatedPod("data-0", "6.1.0"),
+				outdatedPod("data-1", "6.1.0"),
+			}
+
+			coordinator := NewRollingUpgradeCoordinator(nil, func(*v1.ElasticsearchCluster) esclient.Interface { return esClient }, record.NewFakeRecorder(10))
+
+			changed, err := coordinator.Reconcile(es, pods)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if changed {
+				t.Error("expected Reconcile not to report a change")
+			}
+			if es.Status.UpgradeProgress != nil {
+				t.Error("expected UpgradeProgress to remain unset")
+			}
+			if len(esClient.Calls) != 0 {
+				t.Errorf("expected no Elasticsearch API calls, got %v", esClient.Calls)
+			}
+		})
+	}
+}
+
+func TestRollingUpgradeCoordinatorFinishRollWaitsForGreen(t *testing.T) {
+	esClient := fake.New()
+	esClient.ClusterHealthResponse = &esclient.ClusterHealth{Status: "yellow"}
+
+	es := &v1.ElasticsearchCluster{
+		Spec: v1.ElasticsearchClusterSpec{
+			UpdateStrategy: UpdateStrategyRollingUpdate,
+			Version:        "6.2.0",
+			NodePools:      []*v1.ElasticsearchClusterNodePool{dataPool(2)},
+		},
+		Status: v1.ElasticsearchClusterStatus{
+			UpgradeProgress: &v1.ElasticsearchClusterUpgradeStatus{
+				Pool:       "data",
+				RollingPod: "data-0",
+				RolledPods: 0,
+				TotalPods:  2,
+			},
+		},
+	}
+	pods := []*apiv1.Pod{
+		outdatedPod("data-0", "6.1.0"),
+		outdatedPod("data-1", "6.2.0"),
+	}
+
+	coordinator := NewRollingUpgradeCoordinator(nil, func(*v1.ElasticsearchCluster) esclient.Interface { return esClient }, record.NewFakeRecorder(10))
+
+	changed, err := coordinator.Reconcile(es, pods)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changed {
+		t.Error("expected Reconcile not to report a change while the cluster isn't green yet")
+	}
+	if es.Status.UpgradeProgress.RollingPod != "data-0" {
+		t.Errorf("expected RollingPod to remain 'data-0', got %q", es.Status.UpgradeProgress.RollingPod)
+	}
+
+	for _, call := range esClient.Calls {
+		if call.Method == "PutClusterSettings" {
+			t.Errorf("expected allocation not to be re-enabled before the cluster reports green, got call %v", call)
+		}
+	}
+}
+
+func TestRollingUpgradeCoordinatorFinishRollAdvancesOnceGreen(t *testing.T) {
+	esClient := fake.New()
+	esClient.ClusterHealthResponse = &esclient.ClusterHealth{Status: "green"}
+
+	es := &v1.ElasticsearchCluster{
+		Spec: v1.ElasticsearchClusterSpec{
+			UpdateStrategy: UpdateStrategyRollingUpdate,
+			Version:        "6.2.0",
+			NodePools:      []*v1.ElasticsearchClusterNodePool{dataPool(2)},
+		},
+		Status: v1.ElasticsearchClusterStatus{
+			UpgradeProgress: &v1.ElasticsearchClusterUpgradeStatus{
+				Pool:       "data",
+				RollingPod: "data-0",
+				RolledPods: 0,
+				TotalPods:  2,
+			},
+		},
+	}
+	pods := []*apiv1.Pod{
+		outdatedPod("data-0", "6.1.0"),
+		outdatedPod("data-1", "6.2.0"),
+	}
+
+	coordinator := NewRollingUpgradeCoordinator(nil, func(*v1.ElasticsearchCluster) esclient.Interface { return esClient }, record.NewFakeRecorder(10))
+
+	changed, err := coordinator.Reconcile(es, pods)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !changed {
+		t.Fatal("expected Reconcile to report a change once the cluster is green")
+	}
+	if es.Status.UpgradeProgress.RollingPod != "" {
+		t.Errorf("expected RollingPod to be cleared, got %q", es.Status.UpgradeProgress.RollingPod)
+	}
+	if es.Status.UpgradeProgress.RolledPods != 1 {
+		t.Errorf("expected RolledPods to be incremented to 1, got %d", es.Status.UpgradeProgress.RolledPods)
+	}
+
+	var reenabled bool
+	for _, call := range esClient.Calls {
+		if call.Method != "PutClusterSettings" {
+			continue
+		}
+		settings := call.Args[0].(esclient.ClusterSettings)
+		if settings.Transient["cluster.routing.allocation.enable"] == "all" {
+			reenabled = true
+		}
+	}
+	if !reenabled {
+		t.Error("expected shard allocation to be re-enabled once the cluster returned to green")
+	}
+}
+
+func outdatedPod(name, version string) *apiv1.Pod {
+	return &apiv1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{elasticsearchClusterVersionLabel: version},
+		},
+	}
+}
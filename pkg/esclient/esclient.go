@@ -0,0 +1,259 @@
+// Package esclient provides a small abstraction over the subset of the
+// Elasticsearch REST API that the elasticsearch controller needs to drive
+// health reporting, rolling upgrades, autoscaling and snapshot management.
+// A real implementation talks to the cluster's client Service over HTTP;
+// tests should use the fake implementation in pkg/esclient/fake instead.
+package esclient
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Interface is the set of Elasticsearch REST calls used by the
+// elasticsearch controller.
+type Interface interface {
+	ClusterHealth() (*ClusterHealth, error)
+	NodesStats() (*NodesStats, error)
+	PutClusterSettings(settings ClusterSettings) error
+	SyncedFlush() error
+	CatShards() ([]Shard, error)
+	ExcludeNodeAllocation(nodeName string) error
+	CreateSnapshotRepository(name string, repo SnapshotRepository) error
+	CreateSnapshot(repository, snapshot string) error
+	DeleteSnapshot(repository, snapshot string) error
+	RestoreSnapshot(repository, snapshot string, indices []string) error
+}
+
+// ClusterHealth is the subset of GET /_cluster/health that callers need.
+type ClusterHealth struct {
+	ClusterName         string `json:"cluster_name"`
+	Status              string `json:"status"`
+	NumberOfNodes       int    `json:"number_of_nodes"`
+	NumberOfDataNodes   int    `json:"number_of_data_nodes"`
+	ActivePrimaryShards int    `json:"active_primary_shards"`
+	ActiveShards        int    `json:"active_shards"`
+	RelocatingShards    int    `json:"relocating_shards"`
+	InitializingShards  int    `json:"initializing_shards"`
+	UnassignedShards    int    `json:"unassigned_shards"`
+}
+
+// NodesStats is the subset of GET /_nodes/stats that callers need.
+type NodesStats struct {
+	ClusterName string               `json:"cluster_name"`
+	Nodes       map[string]NodeStats `json:"nodes"`
+}
+
+// NodeStats is a single entry of NodesStats.Nodes.
+type NodeStats struct {
+	Name   string `json:"name"`
+	Master bool   `json:"master"`
+	JVM    struct {
+		Mem struct {
+			HeapUsedPercent int `json:"heap_used_percent"`
+		} `json:"mem"`
+	} `json:"jvm"`
+	FS struct {
+		Total struct {
+			TotalInBytes     int64 `json:"total_in_bytes"`
+			AvailableInBytes int64 `json:"available_in_bytes"`
+		} `json:"total"`
+	} `json:"fs"`
+}
+
+// Shard is a single row of GET /_cat/shards?format=json.
+type Shard struct {
+	Index  string `json:"index"`
+	Shard  string `json:"shard"`
+	PriRep string `json:"prirep"`
+	State  string `json:"state"`
+	Node   string `json:"node"`
+}
+
+// ClusterSettings is the body of PUT /_cluster/settings.
+type ClusterSettings struct {
+	Transient  map[string]interface{} `json:"transient,omitempty"`
+	Persistent map[string]interface{} `json:"persistent,omitempty"`
+}
+
+// SnapshotRepository is the body of PUT /_snapshot/{repo}.
+type SnapshotRepository struct {
+	Type     string                 `json:"type"`
+	Settings map[string]interface{} `json:"settings"`
+}
+
+type client struct {
+	httpClient *http.Client
+	baseURL    string
+}
+
+// New returns the real HTTP implementation of Interface, talking to the
+// given base URL (typically the cluster's client Service, e.g.
+// "http://foo-clients.bar.svc.cluster.local:9200").
+func New(baseURL string) Interface {
+	return &client{
+		httpClient: http.DefaultClient,
+		baseURL:    baseURL,
+	}
+}
+
+func (c *client) ClusterHealth() (*ClusterHealth, error) {
+	health := &ClusterHealth{}
+	if err := c.get("/_cluster/health", health); err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+func (c *client) NodesStats() (*NodesStats, error) {
+	stats := &NodesStats{}
+	if err := c.get("/_nodes/stats", stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (c *client) PutClusterSettings(settings ClusterSettings) error {
+	return c.put("/_cluster/settings", settings, nil)
+}
+
+func (c *client) SyncedFlush() error {
+	return c.post("/_flush/synced", nil, nil)
+}
+
+func (c *client) CatShards() ([]Shard, error) {
+	var shards []Shard
+	if err := c.get("/_cat/shards?format=json", &shards); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+func (c *client) ExcludeNodeAllocation(nodeName string) error {
+	settings := ClusterSettings{
+		Transient: map[string]interface{}{
+			"cluster.routing.allocation.exclude._name": nodeName,
+		},
+	}
+	return c.PutClusterSettings(settings)
+}
+
+func (c *client) CreateSnapshotRepository(name string, repo SnapshotRepository) error {
+	return c.put(fmt.Sprintf("/_snapshot/%s", name), repo, nil)
+}
+
+func (c *client) CreateSnapshot(repository, snapshot string) error {
+	return c.post(fmt.Sprintf("/_snapshot/%s/%s?wait_for_completion=false", repository, snapshot), nil, nil)
+}
+
+func (c *client) DeleteSnapshot(repository, snapshot string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.baseURL+fmt.Sprintf("/_snapshot/%s/%s", repository, snapshot), nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+// RestoreSnapshot triggers an asynchronous restore of snapshot from
+// repository. If indices is non-empty, only those indices are restored;
+// otherwise every index in the snapshot is restored.
+func (c *client) RestoreSnapshot(repository, snapshot string, indices []string) error {
+	body := map[string]interface{}{}
+	if len(indices) > 0 {
+		body["indices"] = strings.Join(indices, ",")
+	}
+	return c.post(fmt.Sprintf("/_snapshot/%s/%s/_restore?wait_for_completion=false", repository, snapshot), body, nil)
+}
+
+// StatusError is returned by the real client when Elasticsearch responds
+// with a non-2xx status code, so callers can distinguish e.g. a 404 from a
+// transport-level failure with IsNotFound.
+type StatusError struct {
+	StatusCode int
+	Path       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status code %d from %s", e.StatusCode, e.Path)
+}
+
+// IsNotFound returns true if err is a StatusError with StatusCode 404.
+func IsNotFound(err error) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == http.StatusNotFound
+}
+
+func (c *client) get(path string, out interface{}) error {
+	resp, err := c.httpClient.Get(c.baseURL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode, Path: path}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *client) put(path string, body, out interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, c.baseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, out)
+}
+
+func (c *client) post(path string, body, out interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, out)
+}
+
+func (c *client) do(req *http.Request, out interface{}) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return &StatusError{StatusCode: resp.StatusCode, Path: fmt.Sprintf("%s %s", req.Method, req.URL.Path)}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,103 @@
+// Package fake provides a scripted implementation of esclient.Interface for
+// use in controller tests, following the same record-and-script pattern as
+// the generated kubernetes fake clientsets.
+package fake
+
+import (
+	"gitlab.jetstack.net/marshal/colonel/pkg/esclient"
+)
+
+// Call records a single invocation made against a Client.
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Client is a scripted, in-memory implementation of esclient.Interface. Each
+// method records its invocation in Calls and returns the response/error
+// fields below, which tests can populate before exercising the controller
+// under test.
+type Client struct {
+	Calls []Call
+
+	ClusterHealthResponse *esclient.ClusterHealth
+	ClusterHealthError    error
+
+	NodesStatsResponse *esclient.NodesStats
+	NodesStatsError    error
+
+	PutClusterSettingsError error
+
+	SyncedFlushError error
+
+	CatShardsResponse []esclient.Shard
+	CatShardsError    error
+
+	ExcludeNodeAllocationError error
+
+	CreateSnapshotRepositoryError error
+	CreateSnapshotError           error
+	DeleteSnapshotError           error
+	RestoreSnapshotError          error
+}
+
+var _ esclient.Interface = &Client{}
+
+// New returns an empty fake Client.
+func New() *Client {
+	return &Client{}
+}
+
+func (c *Client) record(method string, args ...interface{}) {
+	c.Calls = append(c.Calls, Call{Method: method, Args: args})
+}
+
+func (c *Client) ClusterHealth() (*esclient.ClusterHealth, error) {
+	c.record("ClusterHealth")
+	return c.ClusterHealthResponse, c.ClusterHealthError
+}
+
+func (c *Client) NodesStats() (*esclient.NodesStats, error) {
+	c.record("NodesStats")
+	return c.NodesStatsResponse, c.NodesStatsError
+}
+
+func (c *Client) PutClusterSettings(settings esclient.ClusterSettings) error {
+	c.record("PutClusterSettings", settings)
+	return c.PutClusterSettingsError
+}
+
+func (c *Client) SyncedFlush() error {
+	c.record("SyncedFlush")
+	return c.SyncedFlushError
+}
+
+func (c *Client) CatShards() ([]esclient.Shard, error) {
+	c.record("CatShards")
+	return c.CatShardsResponse, c.CatShardsError
+}
+
+func (c *Client) ExcludeNodeAllocation(nodeName string) error {
+	c.record("ExcludeNodeAllocation", nodeName)
+	return c.ExcludeNodeAllocationError
+}
+
+func (c *Client) CreateSnapshotRepository(name string, repo esclient.SnapshotRepository) error {
+	c.record("CreateSnapshotRepository", name, repo)
+	return c.CreateSnapshotRepositoryError
+}
+
+func (c *Client) CreateSnapshot(repository, snapshot string) error {
+	c.record("CreateSnapshot", repository, snapshot)
+	return c.CreateSnapshotError
+}
+
+func (c *Client) DeleteSnapshot(repository, snapshot string) error {
+	c.record("DeleteSnapshot", repository, snapshot)
+	return c.DeleteSnapshotError
+}
+
+func (c *Client) RestoreSnapshot(repository, snapshot string, indices []string) error {
+	c.record("RestoreSnapshot", repository, snapshot, indices)
+	return c.RestoreSnapshotError
+}